@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -13,52 +15,204 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 const (
-	ENCODING_EXT           = ".mp4"
-	ENCODING_PARALLEL_CORE = 8
-	COMMAND_TIMEOUT        = 24 * time.Hour
-	LOOP_WAIT_DEFAULT      = time.Second
-	LOOP_WAIT_MAX          = 1000 * time.Second
+	ENCODING_EXT    = ".mp4"
+	COMMAND_TIMEOUT = 24 * time.Hour
+	LOOP_WAIT_MIN   = time.Second
+	LOOP_WAIT_MAX   = 1000 * time.Second
+
+	DEFAULT_CONFIG_PATH = "himawari-client.yaml"
 )
 
-type Task struct {
-	Id         string
-	Size       int64
-	Name       string
-	PresetData string
-	Command    string
-	Args       []string
+// Task.Mode の値。サーバー側がどちらの転送方式を使うか選ぶ。
+const (
+	TaskModeMP4 = "mp4"
+	TaskModeHLS = "hls"
+)
+
+const (
+	HLS_PLAYLIST_NAME     = "playlist.m3u8"
+	HLS_SEGMENT_PATTERN   = "seg_%05d.ts"
+	HLS_SEGMENT_EXT       = ".ts"
+	HLS_SEGMENT_SECONDS   = 6
+	HLS_UPLOAD_WORKERS    = 4
+	HLS_SCAN_INTERVAL     = 500 * time.Millisecond
+	HLS_STABLE_SCAN_COUNT = 2 // この回数連続でサイズが変化しなければ書き込み完了とみなす
+)
+
+const (
+	PROGRESS_REPORT_INTERVAL = 5 * time.Second
+	PROGRESS_STALL_TIMEOUT   = 2 * time.Minute
+)
+
+const FFMPEG_SHUTDOWN_GRACE = 15 * time.Second
+
+// UPLOAD_RETRY_MAX_DURATION: サーバーが復旧しないまま粘り続けてワーカー枠を
+// 専有し続けないよう、再試行し続ける合計時間に上限を設ける。
+const UPLOAD_RETRY_MAX_DURATION = 6 * time.Hour
+
+// ffmpegを打ち切った際のエラー分類。stdinへの"q"(書き込めなければSIGINT)だけで素直に終了した場合はErrFfmpegCancelledで、
+// procTaskMP4はここまでの出力をそのまま転送しにいく。SIGTERM/SIGKILLまでエスカレーションした
+// 場合はErrFfmpegKilledで、出力は壊れている前提で転送を諦める。
+var (
+	ErrFfmpegCancelled = errors.New("ffmpeg: 穏便に打ち切りました")
+	ErrFfmpegKilled    = errors.New("ffmpeg: 強制終了しました")
+)
+
+// Config はhimawari-client.yaml(またはtoml/json/環境変数)から読み込む設定値。
+// ホストやCPU構成はデプロイ先ごとに異なるため、再コンパイル無しで調整できるようにしてある。
+type Config struct {
+	Host             string        `mapstructure:"host"`
+	BaseDir          string        `mapstructure:"base_dir"`
+	ParallelDivisor  int           `mapstructure:"parallel_divisor"`
+	LoopWaitDefault  time.Duration `mapstructure:"loop_wait_default"`
+	LoopWaitMax      time.Duration `mapstructure:"loop_wait_max"`
+	CommandTimeout   time.Duration `mapstructure:"command_timeout"`
+	FfmpegPath       string        `mapstructure:"ffmpeg_path"`
+	CommandWhitelist []string      `mapstructure:"command_whitelist"`
+	LogLevel         string        `mapstructure:"log_level"`
+	ProgressInterval time.Duration `mapstructure:"progress_report_interval"`
+	ProgressStall    time.Duration `mapstructure:"progress_stall_timeout"`
+	ShutdownGrace    time.Duration `mapstructure:"ffmpeg_shutdown_grace"`
+	UploadRetryMax   time.Duration `mapstructure:"upload_retry_max_duration"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		BaseDir:          "/tmp",
+		ParallelDivisor:  8,
+		LoopWaitDefault:  LOOP_WAIT_MIN,
+		LoopWaitMax:      LOOP_WAIT_MAX,
+		CommandTimeout:   COMMAND_TIMEOUT,
+		FfmpegPath:       "ffmpeg",
+		CommandWhitelist: []string{"ffmpeg"},
+		LogLevel:         "info",
+		ProgressInterval: PROGRESS_REPORT_INTERVAL,
+		ProgressStall:    PROGRESS_STALL_TIMEOUT,
+		ShutdownGrace:    FFMPEG_SHUTDOWN_GRACE,
+		UploadRetryMax:   UPLOAD_RETRY_MAX_DURATION,
+	}
+}
+
+func (c *Config) commandAllowed(command string) bool {
+	for _, a := range c.CommandWhitelist {
+		if a == command {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfig は起動時・再読込時の両方で必須項目を確認する。
+// hostが空のまま走らせるとGET http:///taskを延々叩き続けるだけになるので弾く。
+func validateConfig(c *Config) error {
+	if c.Host == "" {
+		return errors.New("hostが設定されていません")
+	}
+	return nil
 }
 
+// cfg は現在有効な設定へのアトミックなポインタ。SIGHUPまたは設定ファイルの変更を
+// 検知すると新しい*Configに丸ごと差し替える。実行中のお仕事はprocTask呼び出し時に
+// 受け取ったスナップショットを使い続けるので、途中で値が変わることはない。
+var cfg atomic.Pointer[Config]
+
+var atomLevel = zap.NewAtomicLevel()
 var log *zap.SugaredLogger
 
 func init() {
-	logger, err := zap.NewProduction()
+	zc := zap.NewProductionConfig()
+	zc.Level = atomLevel
+	logger, err := zc.Build()
 	if err != nil {
 		panic(err)
 	}
 	log = logger.Sugar()
 }
 
+// loadConfig は指定パスの設定ファイルを読み込み、viperインスタンスと初期値を返す。
+// 戻り値のviperはWatchConfig/OnConfigChangeによるホットリロードにそのまま使う。
+func loadConfig(path string) (*viper.Viper, *Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.AutomaticEnv()
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+	c := defaultConfig()
+	if err := v.Unmarshal(c); err != nil {
+		return nil, nil, err
+	}
+	return v, c, nil
+}
+
+// reloadConfig はSIGHUPまたはfsnotifyによる変更検知の両方から呼ばれる共通の再読込処理。
+// パースに失敗した場合はもちろん、validateConfigに通らない場合も今までの設定を
+// 使い続け、cfgは差し替えない。
+func reloadConfig(v *viper.Viper) {
+	if err := v.ReadInConfig(); err != nil {
+		log.Warnw("設定ファイルの読み込みに失敗、今までの設定を使い続けます", "error", err)
+		return
+	}
+	nc := defaultConfig()
+	if err := v.Unmarshal(nc); err != nil {
+		log.Warnw("設定の再読込に失敗、今までの設定を使い続けます", "error", err)
+		return
+	}
+	if err := validateConfig(nc); err != nil {
+		log.Warnw("再読込した設定が不正なため、今までの設定を使い続けます", "error", err)
+		return
+	}
+	cfg.Store(nc)
+	applyLogLevel(nc.LogLevel)
+}
+
+func applyLogLevel(level string) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		log.Warnw("ログレベルの指定が不正です", "level", level, "error", err)
+		return
+	}
+	atomLevel.SetLevel(l)
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		log.Warnw("引数に接続先IPを指定してね", "len", len(os.Args))
+	configPath := DEFAULT_CONFIG_PATH
+	if len(os.Args) >= 2 {
+		configPath = os.Args[1]
+	}
+	v, c, err := loadConfig(configPath)
+	if err != nil {
+		log.Warnw("設定ファイルの読み込みに失敗", "path", configPath, "error", err)
 		os.Exit(1)
 	}
-	host := os.Args[1]
-	base := "/tmp"
-	if len(os.Args) >= 3 {
-		base = os.Args[2]
+	if err := validateConfig(c); err != nil {
+		log.Warnw("設定が不正です", "path", configPath, "error", err)
+		os.Exit(1)
 	}
+	cfg.Store(c)
+	applyLogLevel(c.LogLevel)
+
+	v.OnConfigChange(func(e fsnotify.Event) {
+		log.Infow("設定ファイルの変更を検知、再読込します", "event", e.Name)
+		reloadConfig(v)
+	})
+	v.WatchConfig()
 
 	ctx, stop := signal.NotifyContext(context.Background(),
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
@@ -67,14 +221,24 @@ func main() {
 	)
 	defer stop()
 
-	// エンコード並列数を決定
-	parallel := runtime.NumCPU() / ENCODING_PARALLEL_CORE
+	// SIGHUPはプロセス終了ではなく設定の再読込に使う
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			log.Infow("SIGHUPを受信、設定を再読込します")
+			reloadConfig(v)
+		}
+	}()
+
+	// エンコード並列数を決定(プロセス起動時の設定で固定。実行中のホットリロードの対象外)
+	parallel := runtime.NumCPU() / c.ParallelDivisor
 	if parallel <= 0 {
 		parallel = 1
 	}
 	syncc := make(chan struct{}, parallel)
 
-	wait := LOOP_WAIT_DEFAULT
+	wait := c.LoopWaitDefault
 	sleep := time.NewTimer(wait)
 MAINLOOP:
 	for {
@@ -85,8 +249,10 @@ MAINLOOP:
 		case <-ctx.Done():
 			break MAINLOOP
 		}
+		// その時点で有効な設定のスナップショットを取得し、このお仕事で使い続ける
+		c := cfg.Load()
 		// お仕事を取得する
-		t, err := getTask(ctx, host)
+		t, err := getTask(ctx, c)
 		if err == nil {
 			log.Infow("お仕事取得成功",
 				"Id", t.Id,
@@ -95,17 +261,18 @@ MAINLOOP:
 				"PresetData", t.PresetData,
 				"Command", t.Command,
 				"Args", t.Args,
+				"Mode", t.Mode,
 			)
-			go func(t *Task) {
+			go func(t *Task, c *Config) {
 				defer func() {
 					// 並列数の開放
 					<-syncc
 				}()
 				// お仕事開始
-				t.procTask(ctx, host, base)
-			}(t)
+				t.procTask(ctx, c)
+			}(t, c)
 			// 待ち時間を初期化
-			wait = LOOP_WAIT_DEFAULT
+			wait = c.LoopWaitDefault
 		} else {
 			log.Infow("お仕事が取得できませんでした", "error", err)
 			// 並列数の開放
@@ -119,8 +286,8 @@ MAINLOOP:
 		select {
 		case <-sleep.C:
 			wait *= 2
-			if wait > LOOP_WAIT_MAX {
-				wait = LOOP_WAIT_MAX
+			if wait > c.LoopWaitMax {
+				wait = c.LoopWaitMax
 			}
 		case <-ctx.Done():
 			break MAINLOOP
@@ -128,10 +295,10 @@ MAINLOOP:
 	}
 }
 
-func getTask(ctx context.Context, host string) (*Task, error) {
+func getTask(ctx context.Context, c *Config) (*Task, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+host+"/task", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+c.Host+"/task", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -152,10 +319,33 @@ func getTask(ctx context.Context, host string) (*Task, error) {
 	if t.Id == "" {
 		return nil, errors.New("UUIDが空になってるよ")
 	}
+	if t.Mode == "" {
+		t.Mode = TaskModeMP4
+	}
 	return &t, nil
 }
 
-func (t *Task) procTask(ctx context.Context, host, base string) {
+type Task struct {
+	Id         string
+	Size       int64
+	Name       string
+	PresetData string
+	Command    string
+	Args       []string
+	Mode       string
+}
+
+// procTask はサーバーから指定されたモードに応じて処理を振り分ける。
+func (t *Task) procTask(ctx context.Context, c *Config) {
+	switch t.Mode {
+	case TaskModeHLS:
+		t.procTaskHLS(ctx, c)
+	default:
+		t.procTaskMP4(ctx, c)
+	}
+}
+
+func (t *Task) procTaskMP4(ctx context.Context, c *Config) {
 	// プリセットファイルの生成
 	ppath, err := t.preset()
 	if err != nil {
@@ -165,22 +355,36 @@ func (t *Task) procTask(ctx context.Context, host, base string) {
 	// 作業が終わったらプリセットを消す
 	defer os.Remove(ppath)
 
-	ename := filepath.Join(base, t.Id+ENCODING_EXT)
+	ename := filepath.Join(c.BaseDir, t.Id+ENCODING_EXT)
 	// エンコード実行
-	c, err := t.ffmpeg(ctx, ppath, ename)
-	if err != nil {
-		log.Warnw("ffmpegの実行に失敗", "error", err, "command", c)
+	cmdline, err := t.ffmpeg(ctx, c, ppath, ename)
+	cancelledCleanly := errors.Is(err, ErrFfmpegCancelled)
+	if err != nil && !cancelledCleanly {
+		log.Warnw("ffmpegの実行に失敗", "error", err, "command", cmdline)
 		return
 	}
 	// 作業が終わったらエンコード済みファイルを消す
 	defer os.Remove(ename)
-	log.Infow("エンコード成功",
-		"Id", t.Id,
-		"Name", t.Name,
-	)
+	if cancelledCleanly {
+		// moov atomまで書き終えているはずなので、ここまでの出力を転送しにいく
+		log.Warnw("ffmpegを穏便に打ち切ったので、ここまでの出力を転送します", "Id", t.Id, "error", err)
+	} else {
+		log.Infow("エンコード成功",
+			"Id", t.Id,
+			"Name", t.Name,
+		)
+	}
 
 	// エンコード後ビデオの転送
-	err = t.postVideo(ctx, host, ename)
+	uploadCtx := ctx
+	if cancelledCleanly {
+		// ctxは(SIGINT/SIGTERMやタイムアウトで)既にDoneになっている可能性が高く、
+		// そのまま使うとpostVideoのHTTPリクエストが即座に失敗して救済アップロードが
+		// 成立しない。ここまで書けた部分出力は送る価値があるので、親のキャンセルを
+		// 引き継がない別のコンテキストで送信する。
+		uploadCtx = context.WithoutCancel(ctx)
+	}
+	err = t.postVideo(uploadCtx, c, ename)
 	if err != nil {
 		log.Warnw("エンコード後ビデオの転送に失敗", "error", err)
 		return
@@ -189,7 +393,358 @@ func (t *Task) procTask(ctx context.Context, host, base string) {
 	return
 }
 
-func (t *Task) postVideo(ctx context.Context, host, ename string) error {
+// procTaskHLS はffmpegにHLSラダーを書き出させながら、確定したセグメントを
+// 片っ端からサーバーへアップロードしていく。エンコードの完了を待たずに
+// サーバー側がリマックス/配信を始められるので、長尺動画での体感レイテンシが縮む。
+func (t *Task) procTaskHLS(ctx context.Context, c *Config) {
+	// プリセットファイルの生成
+	ppath, err := t.preset()
+	if err != nil {
+		log.Warnw("presetの生成に失敗", "error", err, "path", ppath)
+		return
+	}
+	defer os.Remove(ppath)
+
+	workdir := filepath.Join(c.BaseDir, t.Id)
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		log.Warnw("作業ディレクトリの作成に失敗", "error", err, "path", workdir)
+		return
+	}
+	// 作業が終わったらセグメント一式を消す
+	defer os.RemoveAll(workdir)
+
+	playlist := filepath.Join(workdir, HLS_PLAYLIST_NAME)
+	segPattern := filepath.Join(workdir, HLS_SEGMENT_PATTERN)
+
+	ctx, cancel := context.WithTimeout(ctx, c.CommandTimeout)
+	defer cancel()
+
+	cmd, err := t.ffmpegStartHLS(ctx, c, ppath, playlist, segPattern)
+	if err != nil {
+		log.Warnw("ffmpegの起動に失敗", "error", err)
+		return
+	}
+
+	uploadc := make(chan hlsSegment, HLS_UPLOAD_WORKERS*2)
+	var wg sync.WaitGroup
+	for i := 0; i < HLS_UPLOAD_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seg := range uploadc {
+				if err := t.postSegment(ctx, c, seg); err != nil {
+					log.Warnw("セグメント転送に失敗", "error", err, "seq", seg.seq, "path", seg.path)
+				}
+			}
+		}()
+	}
+
+	stopc := make(chan struct{})
+	scandone := make(chan struct{})
+	go func() {
+		defer close(scandone)
+		t.watchSegments(ctx, workdir, playlist, uploadc, stopc)
+	}()
+
+	waitErr := cmd.Wait()
+	// ffmpegが終わったら最後にもう一度だけ走査して、最終セグメントを取りこぼさないようにする
+	close(stopc)
+	<-scandone
+	close(uploadc)
+	wg.Wait()
+
+	if waitErr != nil {
+		log.Warnw("ffmpegの実行に失敗", "error", waitErr)
+		return
+	}
+	log.Infow("エンコード成功(HLS)", "Id", t.Id, "Name", t.Name)
+
+	if err := t.postPlaylist(ctx, c, playlist); err != nil {
+		log.Warnw("プレイリストの転送に失敗", "error", err)
+		return
+	}
+	log.Infow("お仕事完了", "Id", t.Id, "Name", t.Name)
+}
+
+type hlsSegment struct {
+	path     string
+	seq      int
+	duration float64
+}
+
+type segState struct {
+	size     int64
+	stable   int
+	uploaded bool
+}
+
+// watchSegments はworkdir内の.tsファイルを定期的に走査し、サイズが
+// HLS_STABLE_SCAN_COUNT回連続で変化しなかったセグメントを書き込み完了とみなしてuploadcへ流す。
+// stopcが閉じられたら最後にもう一度だけ走査してから戻る。
+func (t *Task) watchSegments(ctx context.Context, workdir, playlist string, uploadc chan<- hlsSegment, stopc <-chan struct{}) {
+	seen := make(map[string]*segState)
+	ticker := time.NewTicker(HLS_SCAN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopc:
+			// ffmpegは既に終了しているので、最終走査ではサイズ安定待ちをせず
+			// プレイリストに載っている残り全セグメントを確定扱いでアップロードする
+			t.scanSegments(workdir, playlist, uploadc, seen, true)
+			return
+		case <-ticker.C:
+			t.scanSegments(workdir, playlist, uploadc, seen, false)
+		}
+	}
+}
+
+// scanSegments はworkdir内の.tsファイルを走査してuploadcへ流す。finalがtrueの時は
+// ffmpeg終了後の最終走査であることを示し、サイズ安定待ち(HLS_STABLE_SCAN_COUNT)を
+// 待たずにプレイリストへ載っているセグメントをそのまま確定扱いする。書き込み中に
+// ffmpegが終了した最後のセグメントも、そうしないと安定回数に届かず永遠にアップロード
+// されないままになる。
+func (t *Task) scanSegments(workdir, playlist string, uploadc chan<- hlsSegment, seen map[string]*segState, final bool) {
+	entries, err := os.ReadDir(workdir)
+	if err != nil {
+		log.Warnw("作業ディレクトリの走査に失敗", "error", err, "path", workdir)
+		return
+	}
+	durations, order := parsePlaylistDurations(playlist)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != HLS_SEGMENT_EXT {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		st, ok := seen[e.Name()]
+		if !ok {
+			st = &segState{}
+			seen[e.Name()] = st
+		}
+		if st.uploaded {
+			continue
+		}
+		if info.Size() == st.size && info.Size() > 0 {
+			st.stable++
+		} else {
+			st.stable = 0
+			st.size = info.Size()
+		}
+		if st.stable < HLS_STABLE_SCAN_COUNT && !final {
+			continue
+		}
+		seq, inPlaylist := order[e.Name()]
+		if !inPlaylist {
+			// まだプレイリストに書かれていない = ffmpegがまだ書き込み中
+			continue
+		}
+		st.uploaded = true
+		uploadc <- hlsSegment{
+			path:     filepath.Join(workdir, e.Name()),
+			seq:      seq,
+			duration: durations[e.Name()],
+		}
+	}
+}
+
+// parsePlaylistDurations はローリングm3u8からセグメントファイル名→EXTINF秒数と
+// 出現順(=連番)を読み取る。プレイリストがまだ存在しない場合は空を返す。
+func parsePlaylistDurations(playlist string) (map[string]float64, map[string]int) {
+	durations := make(map[string]float64)
+	order := make(map[string]int)
+	b, err := os.ReadFile(playlist)
+	if err != nil {
+		return durations, order
+	}
+	lines := strings.Split(string(b), "\n")
+	seq := 0
+	var pending float64
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			v = strings.TrimSuffix(v, ",")
+			f, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				pending = f
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+			// コメント・空行は無視
+		default:
+			durations[line] = pending
+			order[line] = seq
+			seq++
+		}
+	}
+	return durations, order
+}
+
+// postVideo は完成した動画ファイルを/task/done/{uuid}へ送る。
+// 何時間もCPUを使って作った出力を一度のネットワーク障害で無駄にしないよう、
+// HEADで受信済みバイト数を確認してからContent-Range付きで続きから送り直し、
+// 失敗時はmain()のお仕事取得ループと同じ指数バックオフで再試行する。
+// 再試行の合計時間がc.UploadRetryMaxを超えたら諦めてワーカー枠を開放する。
+func (t *Task) postVideo(ctx context.Context, c *Config, ename string) error {
+	info, err := os.Stat(ename)
+	if err != nil {
+		return err
+	}
+	total := info.Size()
+	if total == 0 {
+		return errors.New("エンコード済みファイルが空です")
+	}
+
+	deadline := time.Now().Add(c.UploadRetryMax)
+	wait := c.LoopWaitDefault
+	var offset int64
+	for attempt := 1; ; attempt++ {
+		off, err := t.headUploadOffset(ctx, c)
+		if err != nil {
+			// HEAD自体が失敗しただけで、サーバーの受信状態が失われたわけではない。
+			// 0に戻すと全送信をやり直すことになり再開可能アップロードの意味が無くなるので、
+			// 直近に確認できたoffsetのまま同じ範囲から再試行する。
+			log.Warnw("アップロード済みバイト数の確認に失敗、直近のoffsetのまま再試行します", "error", err, "offset", offset, "Id", t.Id)
+		} else {
+			offset = off
+		}
+		if offset >= total {
+			return nil
+		}
+
+		sent, err := t.postVideoRange(ctx, c, ename, offset, total)
+		log.Infow("動画アップロード試行",
+			"Id", t.Id, "attempt", attempt, "offset", offset, "total", total, "sent_bytes", sent, "error", err)
+		if err == nil {
+			return nil
+		}
+		if !isRetryableUploadErr(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("アップロードの再試行上限時間(%s)を超えました: %w", c.UploadRetryMax, err)
+		}
+		log.Warnw("動画アップロードに失敗、バックオフして再試行します", "error", err, "wait", wait, "Id", t.Id)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+		if wait > c.LoopWaitMax {
+			wait = c.LoopWaitMax
+		}
+	}
+}
+
+// headUploadOffset はHEAD /task/done/{uuid}を叩いてサーバーが既に受信済みの
+// バイト数を尋ねる。サーバーがX-Himawari-Received-Bytesヘッダで返す想定で、
+// まだ何も受け取っていない(404)場合は0を返す。
+func (t *Task) headUploadOffset(ctx context.Context, c *Config) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", "http://"+c.Host+"/task/done/"+t.Id, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, &uploadStatusError{status: res.StatusCode, text: res.Status}
+	}
+	// ヘッダが無い/パースできない場合を0扱いにすると、postVideo側が「先頭から送り直す」
+	// 判断をしてしまい再開可能アップロードの意味が無くなる。ここはエラーを返し、
+	// 呼び出し元に直近の既知offsetを使い続けさせる。
+	received, err := strconv.ParseInt(res.Header.Get("X-Himawari-Received-Bytes"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("X-Himawari-Received-Bytesヘッダの取得に失敗: %w", err)
+	}
+	return received, nil
+}
+
+// postVideoRange はenameのoffsetバイト目からtotalバイト目までをContent-Range付きで
+// 1回POSTする。SizeWriterで実際に送れたバイト数を数え、途中で切れても呼び出し元が
+// ログに残せるようにする。
+func (t *Task) postVideoRange(ctx context.Context, c *Config, ename string, offset, total int64) (int64, error) {
+	f, err := os.Open(ename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	sw := NewSizeWriter(io.Discard)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+c.Host+"/task/done/"+t.Id, io.TeeReader(f, sw))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = total - offset
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, total-1, total))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return sw.size, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return sw.size, &uploadStatusError{status: res.StatusCode, text: res.Status}
+	}
+	return sw.size, nil
+}
+
+// uploadStatusError はアップロード先から返ってきたHTTPステータスを保持する。
+// 5xx(サーバー側の一時的な不調)だけをリトライ対象にするために使う。
+type uploadStatusError struct {
+	status int
+	text   string
+}
+
+func (e *uploadStatusError) Error() string {
+	return fmt.Sprintf("bad status: %s", e.text)
+}
+
+// isRetryableUploadErr はネットワークエラー(err自体)や5xxなど、やり直せば
+// 成功する見込みがあるエラーかどうかを判定する。4xxなどはリトライしても
+// 無駄なので呼び出し元はそこで諦める。
+func isRetryableUploadErr(err error) bool {
+	var se *uploadStatusError
+	if errors.As(err, &se) {
+		return se.status >= 500
+	}
+	return true
+}
+
+// postSegment はffmpegが吐き出した1つの.tsセグメントを/task/segmentへ送る。
+func (t *Task) postSegment(ctx context.Context, c *Config, seg hlsSegment) error {
+	extra := map[string]string{
+		"seq":      strconv.Itoa(seg.seq),
+		"duration": strconv.FormatFloat(seg.duration, 'f', -1, 64),
+	}
+	return t.postFile(ctx, c, "/task/segment", "segment", seg.path, extra)
+}
+
+// postPlaylist はHLSエンコード完了後、最終的なマスタープレイリストを/task/doneへ送る。
+func (t *Task) postPlaylist(ctx context.Context, c *Config, playlist string) error {
+	return t.postFile(ctx, c, "/task/done", "playlist", playlist, nil)
+}
+
+// postFile はuuidフィールドと任意の追加フィールド、ファイル本体をmultipartで
+// c.HostのendpointへPOSTする共通処理。
+func (t *Task) postFile(ctx context.Context, c *Config, endpoint, field, fpath string, extra map[string]string) error {
 	pr, pw := io.Pipe()
 	w := multipart.NewWriter(pw)
 
@@ -198,31 +753,37 @@ func (t *Task) postVideo(ctx context.Context, host, ename string) error {
 		defer w.Close() // 閉じることでPOSTデータが出来上がる模様
 		err := w.WriteField("uuid", t.Id)
 		if err != nil {
-			log.Warnw("uuidフィールド作成に失敗しました。", "filepath", ename, "error", err)
+			log.Warnw("uuidフィールド作成に失敗しました。", "filepath", fpath, "error", err)
 			return
 		}
-		_, file := filepath.Split(ename)
-		fw, err := w.CreateFormFile("videodata", file)
+		for k, v := range extra {
+			if err := w.WriteField(k, v); err != nil {
+				log.Warnw("フィールド作成に失敗しました。", "field", k, "filepath", fpath, "error", err)
+				return
+			}
+		}
+		_, file := filepath.Split(fpath)
+		fw, err := w.CreateFormFile(field, file)
 		if err != nil {
-			log.Warnw("パート作成に失敗しました。", "filepath", ename, "error", err)
+			log.Warnw("パート作成に失敗しました。", "filepath", fpath, "error", err)
 			return
 		}
-		rfp, err := os.Open(ename)
+		rfp, err := os.Open(fpath)
 		if err != nil {
-			log.Warnw("動画ファイルオープンに失敗しました。", "filepath", ename, "error", err)
+			log.Warnw("ファイルオープンに失敗しました。", "filepath", fpath, "error", err)
 			return
 		}
 		defer rfp.Close()
 		_, cerr := io.Copy(fw, rfp)
 		if cerr != nil {
-			log.Warnw("パイプ書き込みに失敗しました。", "filepath", ename, "error", cerr)
+			log.Warnw("パイプ書き込みに失敗しました。", "filepath", fpath, "error", cerr)
 			return
 		}
 	}()
 
 	ctx, cancel := context.WithTimeout(ctx, time.Hour)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+host+"/task/done", pr)
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+c.Host+endpoint, pr)
 	if err != nil {
 		return err
 	}
@@ -253,20 +814,264 @@ func (t *Task) preset() (string, error) {
 	return ppath, nil
 }
 
-func (t *Task) ffmpeg(ctx context.Context, ppath, outpath string) (string, error) {
-	ctx, cancel := context.WithTimeout(ctx, COMMAND_TIMEOUT)
+// ffmpeg はffmpegを起動してエンコードを待つ。exec.CommandContextの自動killは
+// SIGKILL一発でmoov atomを書く前に殺してしまい出力が使い物にならないので使わない。
+// 代わりにshutdownSignalerでctx.Doneを監視し、SIGINT→猶予→SIGTERM→猶予→SIGKILLと
+// 段階的にエスカレーションする。scanProgressがstdoutを読み切る(=ffmpegが終了する)まで
+// cmd.Waitは呼べない(os/execの制約)ので、シグナル送出はそれとは別ゴルーチンで
+// ctx.Doneを直接監視し、<-scandoneの手前でブロックしないようにしている。
+func (t *Task) ffmpeg(ctx context.Context, c *Config, ppath, outpath string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.CommandTimeout)
 	defer cancel()
-	if t.Command != "ffmpeg" {
+	if t.Command != "ffmpeg" || !c.commandAllowed(t.Command) {
 		return "", errors.New("想定していないコマンド")
 	}
-	args := make([]string, len(t.Args), len(t.Args)+1)
+	args := make([]string, len(t.Args), len(t.Args)+4)
 	copy(args, t.Args)
-	args = append(args, "-fpre", ppath)
+	args = append(args, "-fpre", ppath, "-progress", "pipe:1", "-nostats")
 	args = append(args, outpath)
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-	//cmd.Stdout = os.Stdout
+	cmd := exec.Command(c.FfmpegPath, args...)
+	// プロセスグループごとシグナルを送れるようにしておく
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	//cmd.Stderr = os.Stderr
-	return cmd.String(), cmd.Run()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return cmd.String(), err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return cmd.String(), err
+	}
+	if err := cmd.Start(); err != nil {
+		return cmd.String(), err
+	}
+
+	progressc := make(chan progressSnapshot, 8)
+	scandone := make(chan struct{})
+	go func() {
+		defer close(scandone)
+		t.scanProgress(stdout, outpath, progressc)
+	}()
+	go t.reportProgress(ctx, c, cancel, progressc)
+
+	classc := make(chan error, 1)
+	go func() {
+		classc <- t.shutdownSignaler(ctx, cmd, stdin, scandone, c.ShutdownGrace)
+	}()
+
+	// cmd.Waitを呼ぶ前にstdoutを読み切っておく必要がある(os/execの制約)。
+	// shutdownSignalerは↑のgoroutineでctx.Doneを並行して見ているので、
+	// ここでブロックしていてもSIGINT等の送出が遅れることはない。
+	<-scandone
+	waitErr := cmd.Wait()
+	if sentinel := <-classc; sentinel != nil {
+		return cmd.String(), wrapFfmpegErr(sentinel, waitErr)
+	}
+	return cmd.String(), waitErr
+}
+
+// shutdownSignaler はctx.Doneを監視し、打ち切りが必要になったらstdinへの"q"(書き込めなければSIGINT)→
+// 猶予待ち→SIGTERM→猶予待ち→SIGKILLの順にプロセスグループへシグナルを送る。
+// scandoneはffmpeg終了(=stdoutがEOFになった)の合図として使い、各段階で
+// それを待つことでscanProgress側のゴルーチンと独立に動ける。
+// 戻り値はcmd.Waitの結果に被せる分類用エラーで、打ち切りが発生しなければnil。
+func (t *Task) shutdownSignaler(ctx context.Context, cmd *exec.Cmd, stdin io.WriteCloser, scandone <-chan struct{}, grace time.Duration) error {
+	select {
+	case <-scandone:
+		return nil
+	case <-ctx.Done():
+	}
+
+	pgid := cmd.Process.Pid
+	log.Infow("ffmpegへ終了要求を送ります", "Id", t.Id, "pid", pgid)
+	if _, err := io.WriteString(stdin, "q\n"); err != nil {
+		syscall.Kill(-pgid, syscall.SIGINT)
+	}
+	select {
+	case <-scandone:
+		return ErrFfmpegCancelled
+	case <-time.After(grace):
+	}
+
+	log.Warnw("猶予時間内に終了しなかったのでSIGTERMを送ります", "Id", t.Id, "pid", pgid)
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-scandone:
+		return ErrFfmpegKilled
+	case <-time.After(grace):
+	}
+
+	log.Warnw("SIGTERMにも応答しないのでSIGKILLします", "Id", t.Id, "pid", pgid)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	<-scandone
+	return ErrFfmpegKilled
+}
+
+func wrapFfmpegErr(sentinel, err error) error {
+	if err == nil {
+		return sentinel
+	}
+	return fmt.Errorf("%w: %v", sentinel, err)
+}
+
+type progressSnapshot struct {
+	encodedMs   int64
+	frame       int64
+	fps         float64
+	bitrate     string
+	speed       float64
+	outputBytes int64
+}
+
+// scanProgress は`-progress pipe:1`の出力(key=value行)をパースしてprogresscへ流す。
+// ffmpegは動画データを直接outpathへ書き込むため、SizeWriterで正確なバイト数を
+// 横取りすることはできない。出力ファイルのサイズをstatできる時はそれをそのまま使い、
+// できない時だけSizeWriterで数えた進捗ストリーム自体の消費バイト数で代用する。
+func (t *Task) scanProgress(stdout io.Reader, outpath string, progressc chan<- progressSnapshot) {
+	defer close(progressc)
+	sw := NewSizeWriter(io.Discard)
+	sc := bufio.NewScanner(io.TeeReader(stdout, sw))
+	var cur progressSnapshot
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), "=")
+		if !ok {
+			continue
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		switch k {
+		case "out_time_ms":
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				cur.encodedMs = ms / 1000
+			}
+		case "frame":
+			if f, err := strconv.ParseInt(v, 10, 64); err == nil {
+				cur.frame = f
+			}
+		case "fps":
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				cur.fps = f
+			}
+		case "bitrate":
+			cur.bitrate = v
+		case "speed":
+			if f, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64); err == nil {
+				cur.speed = f
+			}
+		case "progress":
+			if info, err := os.Stat(outpath); err == nil {
+				cur.outputBytes = info.Size()
+			} else {
+				cur.outputBytes = sw.size
+			}
+			progressc <- cur
+		}
+	}
+}
+
+// reportProgress はprogresscから受け取った最新のスナップショットを一定間隔で
+// サーバーへハートビートとして送る。progresscが一定時間(c.ProgressStall)
+// 届かない場合は、ffmpegが止まっているとみなしてcancelを呼びループの手前へ戻す。
+func (t *Task) reportProgress(ctx context.Context, c *Config, cancel context.CancelFunc, progressc <-chan progressSnapshot) {
+	ticker := time.NewTicker(c.ProgressInterval)
+	defer ticker.Stop()
+	stall := time.NewTimer(c.ProgressStall)
+	defer stall.Stop()
+	var latest progressSnapshot
+	var have bool
+	for {
+		select {
+		case snap, ok := <-progressc:
+			if !ok {
+				return
+			}
+			latest, have = snap, true
+			if !stall.Stop() {
+				<-stall.C
+			}
+			stall.Reset(c.ProgressStall)
+		case <-ticker.C:
+			if !have {
+				continue
+			}
+			if err := t.postProgress(ctx, c, latest); err != nil {
+				log.Warnw("進捗reportの送信に失敗", "error", err, "Id", t.Id)
+			}
+		case <-stall.C:
+			log.Warnw("ffmpegの進捗報告が途絶えたため打ち切ります", "Id", t.Id, "timeout", c.ProgressStall)
+			cancel()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// postProgress は進捗スナップショットをJSONで/task/progressへ送る。
+// これはサーバーにとって生存確認も兼ねており、滞った仕事の再割り当て判断に使われる。
+func (t *Task) postProgress(ctx context.Context, c *Config, snap progressSnapshot) error {
+	body, err := json.Marshal(struct {
+		UUID        string  `json:"uuid"`
+		EncodedMs   int64   `json:"encoded_ms"`
+		Frame       int64   `json:"frame"`
+		Fps         float64 `json:"fps"`
+		Bitrate     string  `json:"bitrate"`
+		Speed       float64 `json:"speed"`
+		OutputBytes int64   `json:"output_bytes"`
+	}{
+		UUID:        t.Id,
+		EncodedMs:   snap.encodedMs,
+		Frame:       snap.frame,
+		Fps:         snap.fps,
+		Bitrate:     snap.bitrate,
+		Speed:       snap.speed,
+		OutputBytes: snap.outputBytes,
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+c.Host+"/task/progress", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", res.Status)
+	}
+	return nil
+}
+
+// ffmpegStartHLS はHLSラダーを書き出すffmpegを起動する。Runではなく
+// Start+Waitで組み立てるのは、呼び出し元がエンコード中にセグメント監視を
+// 並行で回す必要があるため。
+func (t *Task) ffmpegStartHLS(ctx context.Context, c *Config, ppath, playlist, segPattern string) (*exec.Cmd, error) {
+	if t.Command != "ffmpeg" || !c.commandAllowed(t.Command) {
+		return nil, errors.New("想定していないコマンド")
+	}
+	args := make([]string, len(t.Args), len(t.Args)+10)
+	copy(args, t.Args)
+	args = append(args,
+		"-fpre", ppath,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(HLS_SEGMENT_SECONDS),
+		// デフォルトの5分割スライディングウィンドウのままだと、postPlaylistで
+		// 送る最終プレイリストが末尾の数セグメントしか参照しない不完全なものになる。
+		// 0を指定して全セグメントを書き続けさせる。
+		"-hls_list_size", "0",
+		"-hls_segment_filename", segPattern,
+		playlist,
+	)
+	cmd := exec.CommandContext(ctx, c.FfmpegPath, args...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
 }
 
 type SizeWriter struct {